@@ -0,0 +1,125 @@
+package common
+
+// RunnerCredentials holds the information needed to authenticate a runner
+// against the GitLab API.
+type RunnerCredentials struct {
+	URL        string `toml:"url" json:"url" short:"u" long:"url" env:"CI_SERVER_URL" description:"Runner URL"`
+	Token      string `toml:"token" json:"token" short:"t" long:"token" env:"CI_SERVER_TOKEN" description:"Runner token"`
+	TLSCAFile  string `toml:"tls-ca-file,omitempty" json:"tls-ca-file,omitempty" long:"tls-ca-file" env:"CI_SERVER_TLS_CA_FILE" description:"File containing the certificate to verify the peer when using HTTPS"`
+	TLSProfile string `toml:"tls-profile,omitempty" json:"tls-profile,omitempty" long:"tls-profile" env:"CI_SERVER_TLS_PROFILE" description:"TLS version/cipher suite policy to use when talking to the GitLab API: secure, default or legacy"`
+}
+
+// TLS profile names accepted by RunnerCredentials.TLSProfile.
+const (
+	TLSProfileSecure  = "secure"
+	TLSProfileDefault = "default"
+	TLSProfileLegacy  = "legacy"
+)
+
+// KubernetesConfig holds the configuration needed by the Kubernetes executor
+// to schedule and manage build pods.
+type KubernetesConfig struct {
+	Host       string `toml:"host" json:"host" long:"host" env:"KUBERNETES_HOST" description:"Optional Kubernetes master host URL"`
+	CertFile   string `toml:"cert_file" json:"cert_file" long:"cert-file" env:"KUBERNETES_CERT_FILE" description:"Optional Kubernetes master auth certificate"`
+	KeyFile    string `toml:"key_file" json:"key_file" long:"key-file" env:"KUBERNETES_KEY_FILE" description:"Optional Kubernetes master auth private key"`
+	CAFile     string `toml:"ca_file" json:"ca_file" long:"ca-file" env:"KUBERNETES_CA_FILE" description:"Optional Kubernetes master auth ca certificate"`
+	Image      string `toml:"image" json:"image" long:"image" env:"KUBERNETES_IMAGE" description:"Default docker image to use for builds when none is specified"`
+	Namespace  string `toml:"namespace" json:"namespace" long:"namespace" env:"KUBERNETES_NAMESPACE" description:"Namespace to run Kubernetes jobs in"`
+	Privileged bool   `toml:"privileged" json:"privileged" long:"privileged" env:"KUBERNETES_PRIVILEGED" description:"Run all containers with the privileged flag enabled"`
+
+	BearerToken     string `toml:"bearer_token,omitempty" json:"bearer_token" long:"bearer-token" env:"KUBERNETES_BEARER_TOKEN" description:"Optional Kubernetes service account token used to authenticate against the API"`
+	BearerTokenFile string `toml:"bearer_token_file,omitempty" json:"bearer_token_file" long:"bearer-token-file" env:"KUBERNETES_BEARER_TOKEN_FILE" description:"Optional file containing the Kubernetes service account token, defaults to the in-cluster token when unset"`
+
+	KubeConfig        string `toml:"kubeconfig,omitempty" json:"kubeconfig" long:"kubeconfig" env:"KUBERNETES_KUBECONFIG" description:"Optional Kubeconfig file used to configure the Kubernetes client"`
+	KubeConfigContext string `toml:"kubeconfig_context,omitempty" json:"kubeconfig_context" long:"kubeconfig-context" env:"KUBERNETES_KUBECONFIG_CONTEXT" description:"Context to use from KubeConfig, defaults to the current context"`
+
+	CAData   []byte `toml:"ca_data,omitempty" json:"ca_data" description:"Optional inline PEM-encoded CA certificate, as an alternative to CAFile"`
+	CertData []byte `toml:"cert_data,omitempty" json:"cert_data" description:"Optional inline PEM-encoded client certificate, as an alternative to CertFile"`
+	KeyData  []byte `toml:"key_data,omitempty" json:"key_data" description:"Optional inline PEM-encoded client key, as an alternative to KeyFile"`
+
+	TLSInsecure bool `toml:"tls_insecure,omitempty" json:"tls_insecure" long:"tls-insecure" env:"KUBERNETES_TLS_INSECURE" description:"Whether to disable verification of the Kubernetes API server TLS certificate; must be set explicitly, it is never implied"`
+
+	CPURequest    string `toml:"cpu_request,omitempty" json:"cpu_request" long:"cpu-request" env:"KUBERNETES_CPU_REQUEST" description:"The CPU allocation requested for build containers"`
+	CPULimit      string `toml:"cpu_limit" json:"cpu_limit" long:"cpu-limit" env:"KUBERNETES_CPU_LIMIT" description:"The CPU allocation given to build containers"`
+	MemoryRequest string `toml:"memory_request,omitempty" json:"memory_request" long:"memory-request" env:"KUBERNETES_MEMORY_REQUEST" description:"The amount of memory requested for build containers"`
+	MemoryLimit   string `toml:"memory_limit" json:"memory_limit" long:"memory-limit" env:"KUBERNETES_MEMORY_LIMIT" description:"The amount of memory allocated to build containers"`
+
+	EphemeralStorageRequest string `toml:"ephemeral_storage_request,omitempty" json:"ephemeral_storage_request" long:"ephemeral-storage-request" env:"KUBERNETES_EPHEMERAL_STORAGE_REQUEST" description:"The ephemeral storage requested for build containers"`
+	EphemeralStorageLimit   string `toml:"ephemeral_storage_limit,omitempty" json:"ephemeral_storage_limit" long:"ephemeral-storage-limit" env:"KUBERNETES_EPHEMERAL_STORAGE_LIMIT" description:"The ephemeral storage limit for build containers"`
+
+	// ExtendedResources maps an arbitrary resource name (e.g. "nvidia.com/gpu",
+	// "hugepages-2Mi") to the quantity requested and limited for build
+	// containers, for resources Kubernetes schedules beyond CPU/memory.
+	ExtendedResources map[string]string `toml:"extended_resources,omitempty" json:"extended_resources" long:"extended-resources" description:"A toml table/json object of resource name to quantity, for extended resources such as nvidia.com/gpu"`
+
+	NodeSelector map[string]string `toml:"node_selector,omitempty" json:"node_selector" long:"node-selector" description:"A toml table/json object of key=value. Build pods will only be scheduled on nodes matching this selector"`
+
+	// NodeTolerations maps "key=value:Effect" to a toleration operator, so
+	// build pods can be scheduled onto nodes that would otherwise repel them.
+	NodeTolerations map[string]string `toml:"node_tolerations,omitempty" json:"node_tolerations" long:"node-tolerations" description:"A toml table/json object of key=value:Effect to tolerations that build pods will tolerate"`
+
+	Affinity KubernetesAffinity `toml:"affinity,omitempty" json:"affinity" description:"Affinity settings for the build pod"`
+
+	PriorityClassName  string `toml:"priority_class_name,omitempty" json:"priority_class_name" long:"priority-class-name" env:"KUBERNETES_PRIORITY_CLASS_NAME" description:"If set, the Kubernetes Priority Class to be used for the build pod"`
+	ServiceAccountName string `toml:"service_account,omitempty" json:"service_account" long:"service-account" env:"KUBERNETES_SERVICE_ACCOUNT" description:"The Service Account to be used for the build pod"`
+
+	PollInterval int `toml:"poll_interval" json:"poll_interval" long:"poll-interval" env:"KUBERNETES_POLL_INTERVAL" description:"How frequently, in seconds, the runner will poll the Kubernetes pod it has just created to check its status"`
+	PollTimeout  int `toml:"poll_timeout" json:"poll_timeout" long:"poll-timeout" env:"KUBERNETES_POLL_TIMEOUT" description:"The total amount of time, in seconds, that needs to pass before the runner will timeout attempting to connect to the pod it has just created"`
+
+	PodReadyTimeout int `toml:"pod_ready_timeout" json:"pod_ready_timeout" long:"pod-ready-timeout" env:"KUBERNETES_POD_READY_TIMEOUT" description:"How long, in seconds, to wait for the build pod to reach Running with all containers Ready before giving up"`
+
+	// SecretsNamespace overrides the namespace ephemeral per-job Secret and
+	// ConfigMap objects (created for Masked/File build variables) are placed
+	// in; it defaults to Namespace when unset.
+	SecretsNamespace string `toml:"secrets_namespace,omitempty" json:"secrets_namespace" long:"secrets-namespace" env:"KUBERNETES_SECRETS_NAMESPACE" description:"Namespace to create ephemeral per-job Secrets/ConfigMaps in, defaults to Namespace"`
+}
+
+// KubernetesAffinity mirrors the scheduling affinity/anti-affinity rules a
+// build pod can carry. It's expressed with plain strings rather than the
+// upstream Kubernetes API types so runner configs stay readable TOML/JSON;
+// the kubernetes executor's buildAffinity translates it into an api.Affinity.
+type KubernetesAffinity struct {
+	NodeAffinity *KubernetesNodeAffinity `toml:"node_affinity,omitempty" json:"node_affinity,omitempty"`
+}
+
+// KubernetesNodeAffinity expresses a required node affinity as a list of
+// "key=value" match expressions, all of which must hold.
+type KubernetesNodeAffinity struct {
+	RequiredDuringSchedulingIgnoredDuringExecution []string `toml:"required_during_scheduling_ignored_during_execution,omitempty" json:"required_during_scheduling_ignored_during_execution,omitempty"`
+}
+
+// BuildVariableSource tells an executor where a BuildVariable's value comes
+// from, and therefore how it may safely be exposed to a job.
+type BuildVariableSource string
+
+const (
+	// BuildVariableSourceInline is the default: the value is taken as-is
+	// from BuildVariable.Value.
+	BuildVariableSourceInline BuildVariableSource = "inline"
+	// BuildVariableSourceSecretRef means Value is "name/key", a reference
+	// to a key in an existing Secret the executor should not create.
+	BuildVariableSourceSecretRef BuildVariableSource = "secretRef"
+	// BuildVariableSourceConfigMapRef means Value is "name/key", a
+	// reference to a key in an existing ConfigMap.
+	BuildVariableSourceConfigMapRef BuildVariableSource = "configMapRef"
+)
+
+// BuildVariable represents a single CI/CD variable exposed to a job.
+type BuildVariable struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Public bool   `json:"public"`
+	// Masked variables must never appear in plaintext in a pod spec or its
+	// audit trail; executors that can, back them with a native secret
+	// store instead of an inline value.
+	Masked bool `json:"masked"`
+	// File variables are made available to the job as a file rather than
+	// (or in addition to) an environment variable.
+	File bool `json:"file"`
+	// Source selects where Value is read from. It defaults to
+	// BuildVariableSourceInline.
+	Source BuildVariableSource `json:"source,omitempty"`
+}
+
+// BuildVariables is a collection of BuildVariable.
+type BuildVariables []BuildVariable
@@ -0,0 +1,10 @@
+package common
+
+import "io"
+
+// JobTrace is the runner's live sink for build output. Executors write raw
+// job output to it as it is produced so it can be streamed to GitLab while
+// the build is still running.
+type JobTrace interface {
+	io.Writer
+}
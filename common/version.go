@@ -0,0 +1,34 @@
+package common
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// version, revision and built are set at build time via -ldflags.
+var (
+	version  = "development"
+	revision = "HEAD"
+	built    = "unknown"
+)
+
+// appVersion describes the runner build that is currently executing.
+type appVersion struct {
+	Version  string
+	Revision string
+	Built    string
+}
+
+// AppVersion is the global version information for the running binary.
+var AppVersion = appVersion{
+	Version:  version,
+	Revision: revision,
+	Built:    built,
+}
+
+// UserAgent returns the value this runner sends as the HTTP User-Agent
+// header on every request with a body to the GitLab API.
+func (v appVersion) UserAgent() string {
+	return fmt.Sprintf("gitlab-ci-multi-runner %s (%s; %s; %s/%s)",
+		v.Version, v.Revision, v.Built, runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,101 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestGetKubeClientConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  common.KubernetesConfig
+		setup   func(t *testing.T)
+		wantErr bool
+	}{
+		{
+			name: "cert file auth requires key file and ca file too",
+			config: common.KubernetesConfig{
+				Host:     "https://example.com",
+				CertFile: "/tmp/does-not-exist-cert.pem",
+			},
+			wantErr: true,
+		},
+		{
+			name: "bearer token without a CA is rejected unless tls_insecure is set",
+			config: common.KubernetesConfig{
+				Host:        "https://example.com",
+				BearerToken: "abc123",
+			},
+			wantErr: true,
+		},
+		{
+			name: "bearer token with tls_insecure opts out of CA verification",
+			config: common.KubernetesConfig{
+				Host:        "https://example.com",
+				BearerToken: "abc123",
+				TLSInsecure: true,
+			},
+		},
+		{
+			name: "bearer token with inline CA data is accepted",
+			config: common.KubernetesConfig{
+				Host:        "https://example.com",
+				BearerToken: "abc123",
+				CAData:      []byte("-----BEGIN CERTIFICATE-----\n...\n-----END CERTIFICATE-----"),
+			},
+		},
+		{
+			name: "custom host with no auth configured and not running in-cluster falls through unauthenticated",
+			config: common.KubernetesConfig{
+				Host: "https://example.com",
+			},
+		},
+		{
+			name: "custom host with no auth configured but running in-cluster defaults to the service account token",
+			config: common.KubernetesConfig{
+				Host:        "https://example.com",
+				TLSInsecure: true,
+			},
+			setup: func(t *testing.T) {
+				t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+				t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+			},
+			// no service account token file exists in the test environment,
+			// so reading it fails - but that's proof the bearer-token path
+			// was actually taken instead of silently falling through.
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			config := tt.config
+			_, err := getKubeClientConfig(&config)
+
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunningInCluster(t *testing.T) {
+	if runningInCluster() {
+		t.Fatal("expected false with no in-cluster env vars set")
+	}
+
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	if !runningInCluster() {
+		t.Fatal("expected true once in-cluster env vars are set")
+	}
+}
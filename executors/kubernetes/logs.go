@@ -0,0 +1,201 @@
+package kubernetes
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	runtimeutil "k8s.io/kubernetes/pkg/util/runtime"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+const (
+	// buildContainerName is the container the job script runs in; its
+	// output is written straight to trace, unlike service containers which
+	// get a prefix.
+	buildContainerName = "build"
+
+	logStreamMinBackoff = 500 * time.Millisecond
+	logStreamMaxBackoff = 10 * time.Second
+)
+
+// streamPodLogs follows every container's log output in pod and writes it
+// to trace as it's produced: the build container unprefixed, every other
+// (service) container multiplexed behind a "[name] " prefix. It returns
+// once ctx is cancelled, pod reaches a terminal phase, or all streams have
+// ended, whichever happens first.
+func streamPodLogs(ctx context.Context, c *client.Client, pod *api.Pod, trace common.JobTrace) {
+	var wg sync.WaitGroup
+
+	for _, container := range pod.Spec.Containers {
+		w := io.Writer(trace)
+		if container.Name != buildContainerName {
+			w = newPrefixWriter(trace, container.Name)
+		}
+
+		wg.Add(1)
+		go func(name string, w io.Writer) {
+			defer wg.Done()
+			streamContainerLogs(ctx, c, pod, name, w)
+		}(container.Name, w)
+	}
+
+	wg.Wait()
+}
+
+// streamContainerLogs follows a single container's logs. If the stream ends
+// before ctx is cancelled (the API server closed the connection, a common
+// occurrence on long builds) it reconnects with SinceTime set to the last
+// line it saw, so the reconnect doesn't duplicate output, backing off
+// exponentially if the reconnect itself keeps failing. It stops retrying,
+// rather than looping at the backoff ceiling forever, once pod has reached
+// a terminal phase - there's nothing left to stream once the pod is gone or
+// finished, and the apiserver will keep refusing GetLogs for it regardless
+// of how long we wait.
+func streamContainerLogs(ctx context.Context, c *client.Client, pod *api.Pod, containerName string, w io.Writer) {
+	defer runtimeutil.HandleCrash()
+
+	backoff := logStreamMinBackoff
+	var sinceTime *unversioned.Time
+
+	for ctx.Err() == nil {
+		stream, err := c.Pods(pod.Namespace).GetLogs(pod.Name, &api.PodLogOptions{
+			Container:  containerName,
+			Follow:     true,
+			Timestamps: true,
+			SinceTime:  sinceTime,
+		}).Stream()
+		if err != nil {
+			if podTerminated(c, pod) {
+				return
+			}
+			if !sleepOrDone(ctx, backoff) {
+				return
+			}
+			backoff = nextLogBackoff(backoff)
+			continue
+		}
+
+		backoff = logStreamMinBackoff
+
+		// close the stream on ctx cancellation so a read blocked on an idle
+		// follow stream returns
+		copied := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				stream.Close()
+			case <-copied:
+			}
+		}()
+
+		if last := copyLogLines(ctx, stream, w, sinceTime); last != nil {
+			sinceTime = last
+		}
+		close(copied)
+		stream.Close()
+
+		if podTerminated(c, pod) {
+			return
+		}
+	}
+}
+
+// podTerminated reports whether pod has reached a terminal phase
+// (Succeeded/Failed), re-fetching its current status from the API server
+// since the pod value streamContainerLogs was given is just a point-in-time
+// snapshot taken before the pod started. A fetch error is treated as
+// non-terminal so a transient apiserver hiccup doesn't stop log streaming
+// early; the outer retry loop's own backoff/ctx handling covers that case.
+func podTerminated(c *client.Client, pod *api.Pod) bool {
+	current, err := c.Pods(pod.Namespace).Get(pod.Name)
+	if err != nil {
+		return false
+	}
+
+	switch current.Status.Phase {
+	case api.PodSucceeded, api.PodFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// copyLogLines copies every line from r to w, stripping the RFC3339Nano
+// timestamp Kubernetes prefixes each line with, and returns the timestamp
+// of the last line seen so the caller can resume from there on reconnect.
+// Lines stamped at or before since are skipped, since a stream resumed with
+// SinceTime can resend lines the previous stream already delivered.
+func copyLogLines(ctx context.Context, r io.ReadCloser, w io.Writer, since *unversioned.Time) *unversioned.Time {
+	scanner := bufio.NewScanner(r)
+	var last *unversioned.Time
+
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return last
+		}
+
+		ts, line := splitLogTimestamp(scanner.Text())
+		if ts != nil {
+			if since != nil && !ts.After(since.Time) {
+				continue
+			}
+			last = ts
+		}
+
+		fmt.Fprintln(w, line)
+	}
+
+	return last
+}
+
+func splitLogTimestamp(line string) (*unversioned.Time, string) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return nil, line
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, line
+	}
+
+	return &unversioned.Time{Time: t}, parts[1]
+}
+
+func nextLogBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > logStreamMaxBackoff {
+		return logStreamMaxBackoff
+	}
+	return next
+}
+
+// prefixWriter prefixes every line written to it before forwarding to w, so
+// multiple containers' logs can be multiplexed into a single trace without
+// interleaving into unreadable noise.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+}
+
+func newPrefixWriter(w io.Writer, containerName string) io.Writer {
+	return &prefixWriter{w: w, prefix: fmt.Sprintf("[%s] ", containerName)}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if _, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
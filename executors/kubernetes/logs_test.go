@@ -0,0 +1,78 @@
+package kubernetes
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNextLogBackoff(t *testing.T) {
+	tests := []struct {
+		cur, want time.Duration
+	}{
+		{logStreamMinBackoff, logStreamMinBackoff * 2},
+		{logStreamMaxBackoff, logStreamMaxBackoff},
+		{logStreamMaxBackoff / 2, logStreamMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := nextLogBackoff(tt.cur); got != tt.want {
+			t.Errorf("nextLogBackoff(%s) = %s, want %s", tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestSplitLogTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantLine string
+		wantTS   bool
+	}{
+		{
+			name:     "well formed timestamped line",
+			line:     "2020-01-02T15:04:05.000000000Z hello world",
+			wantLine: "hello world",
+			wantTS:   true,
+		},
+		{
+			name:     "line with no timestamp",
+			line:     "hello world",
+			wantLine: "hello world",
+			wantTS:   false,
+		},
+		{
+			name:     "line with an unparseable timestamp",
+			line:     "not-a-timestamp hello",
+			wantLine: "not-a-timestamp hello",
+			wantTS:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, line := splitLogTimestamp(tt.line)
+
+			if line != tt.wantLine {
+				t.Errorf("line = %q, want %q", line, tt.wantLine)
+			}
+			if (ts != nil) != tt.wantTS {
+				t.Errorf("ts != nil = %v, want %v", ts != nil, tt.wantTS)
+			}
+		})
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newPrefixWriter(&buf, "service-1")
+
+	if _, err := w.Write([]byte("line one\nline two")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "[service-1] line one\n[service-1] line two\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
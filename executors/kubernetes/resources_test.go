@@ -0,0 +1,237 @@
+package kubernetes
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestResources(t *testing.T) {
+	tests := []struct {
+		name                                                                                     string
+		requestsCPU, requestsMemory, limitsCPU, limitsMemory, ephStorageRequest, ephStorageLimit string
+		extended                                                                                 map[string]string
+		wantErr                                                                                  bool
+	}{
+		{
+			name:           "valid cpu and memory requests and limits",
+			requestsCPU:    "250m",
+			limitsCPU:      "500m",
+			requestsMemory: "64Mi",
+			limitsMemory:   "128Mi",
+		},
+		{
+			name:      "invalid cpu quantity is propagated, not swallowed",
+			limitsCPU: "not-a-quantity",
+			wantErr:   true,
+		},
+		{
+			name:        "cpu request exceeding its limit is rejected",
+			requestsCPU: "1",
+			limitsCPU:   "500m",
+			wantErr:     true,
+		},
+		{
+			name:     "extended resource request and limit",
+			extended: map[string]string{"nvidia.com/gpu": "1"},
+		},
+		{
+			name:     "invalid extended resource quantity is propagated",
+			extended: map[string]string{"nvidia.com/gpu": "not-a-quantity"},
+			wantErr:  true,
+		},
+		{
+			name:              "ephemeral storage requests and limits",
+			ephStorageRequest: "1Gi",
+			ephStorageLimit:   "2Gi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resources(tt.requestsCPU, tt.requestsMemory, tt.limitsCPU, tt.limitsMemory, tt.ephStorageRequest, tt.ephStorageLimit, tt.extended)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none (resources=%+v)", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateRequestsWithinLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests api.ResourceList
+		limits   api.ResourceList
+		wantErr  bool
+	}{
+		{
+			name:     "request under limit is fine",
+			requests: api.ResourceList{api.ResourceCPU: resource.MustParse("250m")},
+			limits:   api.ResourceList{api.ResourceCPU: resource.MustParse("500m")},
+		},
+		{
+			name:     "request equal to limit is fine",
+			requests: api.ResourceList{api.ResourceCPU: resource.MustParse("500m")},
+			limits:   api.ResourceList{api.ResourceCPU: resource.MustParse("500m")},
+		},
+		{
+			name:     "request over limit is rejected",
+			requests: api.ResourceList{api.ResourceCPU: resource.MustParse("1")},
+			limits:   api.ResourceList{api.ResourceCPU: resource.MustParse("500m")},
+			wantErr:  true,
+		},
+		{
+			name:     "request with no matching limit is not checked",
+			requests: api.ResourceList{api.ResourceMemory: resource.MustParse("1Gi")},
+			limits:   api.ResourceList{api.ResourceCPU: resource.MustParse("500m")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRequestsWithinLimits(tt.requests, tt.limits)
+
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestBuildTolerations(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  common.KubernetesConfig
+		want    []api.Toleration
+		wantErr bool
+	}{
+		{
+			name: "no tolerations configured",
+		},
+		{
+			name: "key and value toleration",
+			config: common.KubernetesConfig{
+				NodeTolerations: map[string]string{"node-role=master:NoSchedule": "Equal"},
+			},
+			want: []api.Toleration{
+				{Key: "node-role", Value: "master", Operator: "Equal", Effect: "NoSchedule"},
+			},
+		},
+		{
+			name: "key only toleration",
+			config: common.KubernetesConfig{
+				NodeTolerations: map[string]string{"dedicated:NoExecute": "Exists"},
+			},
+			want: []api.Toleration{
+				{Key: "dedicated", Operator: "Exists", Effect: "NoExecute"},
+			},
+		},
+		{
+			name: "missing effect is rejected",
+			config: common.KubernetesConfig{
+				NodeTolerations: map[string]string{"node-role=master": "Equal"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildTolerations(&tt.config)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none (tolerations=%+v)", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, g := range got {
+					if g == want {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("toleration %+v not found in %+v", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildAffinity(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  common.KubernetesConfig
+		wantNil bool
+		wantErr bool
+	}{
+		{
+			name:    "no affinity configured",
+			wantNil: true,
+		},
+		{
+			name: "valid match expression",
+			config: common.KubernetesConfig{
+				Affinity: common.KubernetesAffinity{
+					NodeAffinity: &common.KubernetesNodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: []string{"disktype=ssd"},
+					},
+				},
+			},
+		},
+		{
+			name: "malformed match expression is rejected",
+			config: common.KubernetesConfig{
+				Affinity: common.KubernetesAffinity{
+					NodeAffinity: &common.KubernetesNodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: []string{"disktype"},
+					},
+				},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildAffinity(&tt.config)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none (affinity=%+v)", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("affinity = %+v, wantNil = %v", got, tt.wantNil)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package kubernetes
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+// ephemeralValueKey is the single data key used in every per-job Secret or
+// ConfigMap this package creates to hold a build variable's value.
+const ephemeralValueKey = "value"
+
+// buildVariables converts bv into pod EnvVar entries for container build.
+// A plain variable is inlined as before. A variable with an explicit
+// SecretRef/ConfigMapRef source references a Secret/ConfigMap the job
+// expects to already exist (Value is "name/key"). A variable marked Masked
+// or File is instead backed by an ephemeral, owner-referenced Secret or
+// ConfigMap created in namespace and garbage collected with pod, so its
+// value never appears inline in the pod spec, `kubectl get pod -o yaml`, or
+// audit logs.
+func buildVariables(c *client.Client, namespace string, pod *api.Pod, bv common.BuildVariables) ([]api.EnvVar, error) {
+	e := make([]api.EnvVar, 0, len(bv))
+
+	for _, b := range bv {
+		envVar, err := buildVariableEnvVar(c, namespace, pod, b)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %s", b.Key, err)
+		}
+		e = append(e, envVar)
+	}
+
+	return e, nil
+}
+
+func buildVariableEnvVar(c *client.Client, namespace string, pod *api.Pod, b common.BuildVariable) (api.EnvVar, error) {
+	switch b.Source {
+	case common.BuildVariableSourceSecretRef:
+		return envVarFromSecretRef(b)
+	case common.BuildVariableSourceConfigMapRef:
+		return envVarFromConfigMapRef(b)
+	}
+
+	switch {
+	case b.Masked:
+		return createEphemeralSecretEnvVar(c, namespace, pod, b)
+	case b.File:
+		return createEphemeralConfigMapEnvVar(c, namespace, pod, b)
+	default:
+		return api.EnvVar{Name: b.Key, Value: b.Value}, nil
+	}
+}
+
+func envVarFromSecretRef(b common.BuildVariable) (api.EnvVar, error) {
+	name, key, err := splitRef(b.Value)
+	if err != nil {
+		return api.EnvVar{}, err
+	}
+
+	return api.EnvVar{
+		Name: b.Key,
+		ValueFrom: &api.EnvVarSource{
+			SecretKeyRef: &api.SecretKeySelector{
+				LocalObjectReference: api.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		},
+	}, nil
+}
+
+func envVarFromConfigMapRef(b common.BuildVariable) (api.EnvVar, error) {
+	name, key, err := splitRef(b.Value)
+	if err != nil {
+		return api.EnvVar{}, err
+	}
+
+	return api.EnvVar{
+		Name: b.Key,
+		ValueFrom: &api.EnvVarSource{
+			ConfigMapKeyRef: &api.ConfigMapKeySelector{
+				LocalObjectReference: api.LocalObjectReference{Name: name},
+				Key:                  key,
+			},
+		},
+	}, nil
+}
+
+func splitRef(value string) (name, key string, err error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf(`expected a "name/key" reference, got %q`, value)
+	}
+	return parts[0], parts[1], nil
+}
+
+// createEphemeralSecretEnvVar creates a Secret holding b's value, owned by
+// pod so it's garbage collected with it, and returns an EnvVar referencing
+// it via SecretKeyRef.
+func createEphemeralSecretEnvVar(c *client.Client, namespace string, pod *api.Pod, b common.BuildVariable) (api.EnvVar, error) {
+	name := ephemeralObjectName(pod.Name, b.Key)
+
+	secret := &api.Secret{
+		ObjectMeta: api.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: podOwnerReference(pod),
+		},
+		Type: api.SecretTypeOpaque,
+		Data: map[string][]byte{
+			ephemeralValueKey: []byte(b.Value),
+		},
+	}
+
+	if _, err := c.Secrets(namespace).Create(secret); err != nil {
+		return api.EnvVar{}, rbacFriendlyError(err, "create", "secrets", namespace)
+	}
+
+	return api.EnvVar{
+		Name: b.Key,
+		ValueFrom: &api.EnvVarSource{
+			SecretKeyRef: &api.SecretKeySelector{
+				LocalObjectReference: api.LocalObjectReference{Name: name},
+				Key:                  ephemeralValueKey,
+			},
+		},
+	}, nil
+}
+
+// createEphemeralConfigMapEnvVar is the ConfigMap equivalent of
+// createEphemeralSecretEnvVar, used for File variables that aren't also
+// Masked.
+func createEphemeralConfigMapEnvVar(c *client.Client, namespace string, pod *api.Pod, b common.BuildVariable) (api.EnvVar, error) {
+	name := ephemeralObjectName(pod.Name, b.Key)
+
+	configMap := &api.ConfigMap{
+		ObjectMeta: api.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			OwnerReferences: podOwnerReference(pod),
+		},
+		Data: map[string]string{
+			ephemeralValueKey: b.Value,
+		},
+	}
+
+	if _, err := c.ConfigMaps(namespace).Create(configMap); err != nil {
+		return api.EnvVar{}, rbacFriendlyError(err, "create", "configmaps", namespace)
+	}
+
+	return api.EnvVar{
+		Name: b.Key,
+		ValueFrom: &api.EnvVarSource{
+			ConfigMapKeyRef: &api.ConfigMapKeySelector{
+				LocalObjectReference: api.LocalObjectReference{Name: name},
+				Key:                  ephemeralValueKey,
+			},
+		},
+	}, nil
+}
+
+func podOwnerReference(pod *api.Pod) []api.OwnerReference {
+	return []api.OwnerReference{
+		{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       pod.Name,
+			UID:        pod.UID,
+		},
+	}
+}
+
+// ephemeralObjectName derives a DNS-1123-safe Secret/ConfigMap name from
+// the pod it belongs to and the build variable it holds.
+func ephemeralObjectName(podName, variableKey string) string {
+	return fmt.Sprintf("%s-%s", podName, sanitizeK8sName(variableKey))
+}
+
+func sanitizeK8sName(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// rbacFriendlyError wraps a Kubernetes API error with a hint about the RBAC
+// permission the runner's service account is most likely missing, since the
+// raw apiserver Forbidden message doesn't spell that out for operators. The
+// hint is only appended when err is actually a Forbidden/Unauthorized
+// response - an AlreadyExists conflict (ephemeralObjectName can collide,
+// e.g. "FOO-BAR" and "FOO_BAR" both sanitize to "foo-bar") or any other
+// failure has nothing to do with RBAC and shouldn't send operators chasing
+// it.
+func rbacFriendlyError(err error, verb, resource, namespace string) error {
+	if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+		return fmt.Errorf("failed to %s %s in namespace %s: %s (does the runner's service account have RBAC permission to %s %s?)",
+			verb, resource, namespace, err.Error(), verb, resource)
+	}
+	return fmt.Errorf("failed to %s %s in namespace %s: %s", verb, resource, namespace, err.Error())
+}
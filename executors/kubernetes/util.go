@@ -3,6 +3,9 @@ package kubernetes
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -10,12 +13,33 @@ import (
 	"k8s.io/kubernetes/pkg/api/resource"
 	"k8s.io/kubernetes/pkg/client/restclient"
 	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	runtimeutil "k8s.io/kubernetes/pkg/util/runtime"
+	"k8s.io/kubernetes/pkg/watch"
 
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
 )
 
+const (
+	// defaultPodReadyTimeout is used whenever KubernetesConfig.PodReadyTimeout
+	// is left unset.
+	defaultPodReadyTimeout = 5 * time.Minute
+
+	watchMinBackoff = 500 * time.Millisecond
+	watchMaxBackoff = 30 * time.Second
+
+	// inClusterTokenFile is where Kubernetes mounts the pod's service
+	// account token; used as the BearerTokenFile default when the runner
+	// itself runs in-cluster but overrides Host.
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
 func getKubeClientConfig(config *common.KubernetesConfig) (*restclient.Config, error) {
 	switch {
+	case len(config.KubeConfig) > 0:
+		return getKubeClientConfigFromFile(config)
 	case len(config.CertFile) > 0:
 		if len(config.KeyFile) == 0 || len(config.CAFile) == 0 {
 			return nil, fmt.Errorf("ca file, cert file and key file must be specified when using file based auth")
@@ -28,6 +52,13 @@ func getKubeClientConfig(config *common.KubernetesConfig) (*restclient.Config, e
 				CAFile:   config.CAFile,
 			},
 		}, nil
+	case len(config.BearerToken) > 0 || len(config.BearerTokenFile) > 0:
+		return getKubeClientConfigFromBearerToken(config)
+	case len(config.Host) > 0 && runningInCluster():
+		// a custom Host with no auth configured, while the runner process
+		// itself is running in-cluster: default to the mounted service
+		// account token rather than falling through to unauthenticated.
+		return getKubeClientConfigFromBearerToken(config)
 	case len(config.Host) > 0:
 		return &restclient.Config{
 			Host: config.Host,
@@ -37,6 +68,73 @@ func getKubeClientConfig(config *common.KubernetesConfig) (*restclient.Config, e
 	}
 }
 
+// runningInCluster reports whether the runner process itself is running
+// inside a Kubernetes pod, using the same env vars restclient.InClusterConfig
+// checks. It's used to decide whether a custom Host should still default to
+// bearer-token auth off the mounted service account token.
+func runningInCluster() bool {
+	return len(os.Getenv("KUBERNETES_SERVICE_HOST")) > 0 && len(os.Getenv("KUBERNETES_SERVICE_PORT")) > 0
+}
+
+// getKubeClientConfigFromFile loads a restclient.Config from a kubeconfig
+// on disk, honoring config.KubeConfigContext to select a non-default
+// context, so runners deployed with a kubeconfig ConfigMap don't have to
+// fall back to CertFile/KeyFile/CAFile.
+func getKubeClientConfigFromFile(config *common.KubernetesConfig) (*restclient.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = config.KubeConfig
+
+	overrides := &clientcmd.ConfigOverrides{}
+	if len(config.KubeConfigContext) > 0 {
+		overrides.CurrentContext = config.KubeConfigContext
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// getKubeClientConfigFromBearerToken authenticates with a bearer token,
+// either provided inline or loaded from a file, defaulting to the in-cluster
+// service account token when the runner overrides Host but is still running
+// inside the cluster. TLS verification is mandatory whenever a bearer token
+// is used, since the token would otherwise be sent in the clear to whatever
+// host answers; InsecureSkipVerify is only honored when the runner opts in
+// explicitly via TLSInsecure.
+func getKubeClientConfigFromBearerToken(config *common.KubernetesConfig) (*restclient.Config, error) {
+	token := config.BearerToken
+
+	if len(token) == 0 {
+		tokenFile := config.BearerTokenFile
+		if len(tokenFile) == 0 {
+			tokenFile = inClusterTokenFile
+		}
+
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token file %q: %s", tokenFile, err.Error())
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	tlsConfig := restclient.TLSClientConfig{
+		CAFile:   config.CAFile,
+		CAData:   config.CAData,
+		CertData: config.CertData,
+		KeyData:  config.KeyData,
+	}
+
+	if !config.TLSInsecure && len(tlsConfig.CAFile) == 0 && len(tlsConfig.CAData) == 0 {
+		return nil, fmt.Errorf("bearer token auth requires a CA file or CA data to verify the Kubernetes API server; set tls_insecure to explicitly disable verification")
+	}
+
+	tlsConfig.Insecure = config.TLSInsecure
+
+	return &restclient.Config{
+		Host:            config.Host,
+		BearerToken:     token,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
 func getKubeClient(config *common.KubernetesConfig) (*client.Client, error) {
 	restConfig, err := getKubeClientConfig(config)
 	if err != nil {
@@ -46,102 +144,355 @@ func getKubeClient(config *common.KubernetesConfig) (*client.Client, error) {
 	return client.New(restConfig)
 }
 
-// waitForPodRunning will use client c to detect when pod reaches the PodRunning
-// state. It will check every second, and will return the final PodPhase once
-// either PodRunning, PodSucceeded or PodFailed has been reached. In the case of
-// PodRunning, it will also wait until all containers within the pod are also Ready
-// Returns error if the call to retreive pod details fails
-func waitForPodRunning(ctx context.Context, c *client.Client, pod *api.Pod, out io.Writer) (api.PodPhase, error) {
-	type resp struct {
-		done  bool
-		phase api.PodPhase
-		err   error
+// waitForPodRunning watches pod until it reaches PodRunning with every
+// container reporting Ready, or a terminal phase (PodSucceeded/PodFailed).
+// It returns as soon as the outcome is known; ctx cancellation and
+// config.PodReadyTimeout (defaulting to defaultPodReadyTimeout) both abort
+// the wait. The watch connection is re-established with exponential backoff
+// if the API server drops it, so a single dropped connection doesn't fail
+// the build.
+func waitForPodRunning(ctx context.Context, c *client.Client, pod *api.Pod, out io.Writer, config *common.KubernetesConfig) (api.PodPhase, error) {
+	timeout := time.Duration(config.PodReadyTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPodReadyTimeout
 	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	events := make(chan *api.Pod)
+	go watchPod(ctx, c, pod, out, events)
+
 	for {
 		select {
-		case r := <-func() <-chan resp {
-			errc := make(chan resp)
-			go func() {
-				defer close(errc)
-				pod, err := c.Pods(pod.Namespace).Get(pod.Name)
+		case p, ok := <-events:
+			if !ok {
+				return api.PodUnknown, fmt.Errorf("watch on pod %s/%s closed unexpectedly", pod.Namespace, pod.Name)
+			}
+
+			switch p.Status.Phase {
+			case api.PodSucceeded:
+				return p.Status.Phase, nil
+			case api.PodFailed:
+				return p.Status.Phase, fmt.Errorf("pod status is failed")
+			case api.PodRunning:
+				ready, err := containersReady(p)
 				if err != nil {
-					errc <- resp{true, api.PodUnknown, err}
-					return
+					return p.Status.Phase, err
 				}
-
-				switch pod.Status.Phase {
-				case api.PodRunning:
-					errc <- resp{true, pod.Status.Phase, nil}
-				case api.PodSucceeded:
-					errc <- resp{true, pod.Status.Phase, fmt.Errorf("pod already succeeded before it begins running")}
-				case api.PodFailed:
-					errc <- resp{true, pod.Status.Phase, fmt.Errorf("pod status is failed")}
-				default:
-					fmt.Fprintf(out, "Waiting for pod %s/%s to be running, status is %s\n", pod.Namespace, pod.Name, pod.Status.Phase)
-					time.Sleep(1 * time.Second)
-					errc <- resp{false, pod.Status.Phase, nil}
+				if ready {
+					return p.Status.Phase, nil
 				}
-			}()
-			return errc
-		}():
-			if r.done {
-				return r.phase, r.err
+				fmt.Fprintf(out, "Waiting for pod %s/%s containers to become ready\n", p.Namespace, p.Name)
+			default:
+				fmt.Fprintf(out, "Waiting for pod %s/%s to be running, status is %s\n", p.Namespace, p.Name, p.Status.Phase)
 			}
-			continue
 		case <-ctx.Done():
 			return api.PodUnknown, ctx.Err()
 		}
 	}
 }
 
-// limits takes a string representing CPU & memory limits,
-// and returns a ResourceList with appropriately scaled Quantity
-// values for Kubernetes. This allows users to write "500m" for CPU,
-// and "50Mi" for memory (etc.)
-func limits(cpu, memory string) (api.ResourceList, error) {
-	var rCPU, rMem *resource.Quantity
-	var err error
+// watchPod streams api.Pod updates for pod into events until ctx is done.
+// A panic inside the watch loop is recovered so it can never take down the
+// runner; the watch is simply torn down and, since events is then closed,
+// waitForPodRunning reports the failure instead of hanging.
+func watchPod(ctx context.Context, c *client.Client, pod *api.Pod, out io.Writer, events chan<- *api.Pod) {
+	defer runtimeutil.HandleCrash()
+	defer close(events)
+
+	backoff := watchMinBackoff
+	selector := fields.OneTermEqualSelector("metadata.name", pod.Name)
+	resourceVersion := pod.ResourceVersion
 
-	parse := func(s string) (*resource.Quantity, error) {
-		var q *resource.Quantity
-		if len(s) == 0 {
-			return q, nil
+	for ctx.Err() == nil {
+		w, err := c.Pods(pod.Namespace).Watch(labels.Everything(), selector, resourceVersion)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to watch pod %s/%s, retrying in %s: %v\n", pod.Namespace, pod.Name, backoff, err)
+			if !sleepOrDone(ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
 		}
-		if q, err = resource.ParseQuantity(s); err != nil {
-			return nil, fmt.Errorf("error parsing resource limit: %s", err.Error())
+
+		backoff = watchMinBackoff
+
+		var reconnect bool
+		resourceVersion, reconnect = drainPodWatch(ctx, w, events, resourceVersion)
+		if !reconnect {
+			return
 		}
-		return q, nil
 	}
+}
+
+// drainPodWatch forwards Modified/Added events to events, returning the
+// resourceVersion to resume from on the next Watch call and whether the
+// caller should re-establish the watch at all. It returns the resourceVersion
+// of the last event actually observed rather than the one the watch was
+// opened with, so a reconnect resumes from where we left off instead of the
+// original (and, for a long-lived pod, likely by-then-compacted) version;
+// on watch.Error - commonly the apiserver reporting the resourceVersion as
+// too old to resume from - it resets to "" so the reconnect falls back to
+// watching the pod's current state instead of retrying the same stale
+// version forever. It returns false once the pod is deleted or ctx is done.
+// Every send to events is itself guarded by ctx, since waitForPodRunning's
+// reader can stop selecting on events (e.g. PodReadyTimeout firing) at the
+// same instant an event is ready here; without the guard this goroutine,
+// and the watch connection it holds open, would leak for the life of the
+// process.
+func drainPodWatch(ctx context.Context, w watch.Interface, events chan<- *api.Pod, resourceVersion string) (nextResourceVersion string, reconnect bool) {
+	defer w.Stop()
+
+	nextResourceVersion = resourceVersion
+
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return nextResourceVersion, true
+			}
+
+			// a watch.Error event carries a Status, not a Pod
+			if event.Type == watch.Error {
+				return "", true
+			}
 
-	if rCPU, err = parse(cpu); err != nil {
-		return api.ResourceList{}, nil
+			p, isPod := event.Object.(*api.Pod)
+			if !isPod {
+				continue
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				nextResourceVersion = p.ResourceVersion
+				if !sendOrDone(ctx, events, p) {
+					return nextResourceVersion, false
+				}
+			case watch.Deleted:
+				p.Status.Phase = api.PodFailed
+				sendOrDone(ctx, events, p)
+				return nextResourceVersion, false
+			}
+		case <-ctx.Done():
+			return nextResourceVersion, false
+		}
 	}
+}
 
-	if rMem, err = parse(memory); err != nil {
-		return api.ResourceList{}, nil
+// sendOrDone sends p on events, reporting false instead of blocking forever
+// if ctx is done before the receiver is ready to accept it.
+func sendOrDone(ctx context.Context, events chan<- *api.Pod, p *api.Pod) bool {
+	select {
+	case events <- p:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	l := make(api.ResourceList)
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	if rCPU != nil {
-		l[api.ResourceLimitsCPU] = *rCPU
+func nextBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > watchMaxBackoff {
+		return watchMaxBackoff
 	}
-	if rMem != nil {
-		l[api.ResourceLimitsMemory] = *rMem
+	return next
+}
+
+// containersReady reports whether every container in pod is Ready. It
+// returns an error if a container is stuck Waiting on a fatal image pull
+// failure, since that will never resolve on its own.
+func containersReady(pod *api.Pod) (bool, error) {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return false, nil
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && isFatalPullReason(waiting.Reason) {
+			return false, fmt.Errorf("container %s failed to start: %s", status.Name, waiting.Reason)
+		}
+		if !status.Ready {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func isFatalPullReason(reason string) bool {
+	switch reason {
+	case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "RegistryUnavailable":
+		return true
+	default:
+		return false
+	}
+}
+
+// buildNodeSelector, buildTolerations and buildAffinity translate the
+// scheduling-related KubernetesConfig fields (NodeSelector, NodeTolerations,
+// Affinity) into their pod spec equivalents; PriorityClassName and
+// ServiceAccountName need no translation and can be read off config
+// directly. This package has no function that assembles a full build pod
+// spec yet - only the pieces (resources, build variable env vars, log
+// streaming, wait/watch) - so nothing calls these three yet. Whatever
+// builds the pod spec must call them to honor these config fields; until it
+// does, they're accepted and parsed but have no effect.
+
+// buildNodeSelector returns config.NodeSelector as-is: its shape already
+// matches api.PodSpec.NodeSelector.
+func buildNodeSelector(config *common.KubernetesConfig) map[string]string {
+	return config.NodeSelector
+}
+
+// buildTolerations parses config.NodeTolerations ("key=value:Effect" ->
+// operator) into api.Toleration entries for the pod spec.
+func buildTolerations(config *common.KubernetesConfig) ([]api.Toleration, error) {
+	if len(config.NodeTolerations) == 0 {
+		return nil, nil
+	}
+
+	tolerations := make([]api.Toleration, 0, len(config.NodeTolerations))
+	for selector, operator := range config.NodeTolerations {
+		keyEffect := strings.SplitN(selector, ":", 2)
+		if len(keyEffect) != 2 {
+			return nil, fmt.Errorf("invalid node toleration %q: expected \"key=value:Effect\"", selector)
+		}
+
+		toleration := api.Toleration{
+			Operator: api.TolerationOp(operator),
+			Effect:   api.TaintEffect(keyEffect[1]),
+		}
+
+		keyValue := strings.SplitN(keyEffect[0], "=", 2)
+		toleration.Key = keyValue[0]
+		if len(keyValue) == 2 {
+			toleration.Value = keyValue[1]
+		}
+
+		tolerations = append(tolerations, toleration)
 	}
 
-	return l, nil
+	return tolerations, nil
 }
 
-// buildVariables converts a common.BuildVariables into a list of
-// kubernetes EnvVar objects
-func buildVariables(bv common.BuildVariables) []api.EnvVar {
-	e := make([]api.EnvVar, len(bv))
-	for i, b := range bv {
-		e[i] = api.EnvVar{
-			Name:  b.Key,
-			Value: b.Value,
+// buildAffinity translates config.Affinity's required node affinity match
+// expressions ("key=value") into an api.Affinity for the pod spec.
+func buildAffinity(config *common.KubernetesConfig) (*api.Affinity, error) {
+	nodeAffinity := config.Affinity.NodeAffinity
+	if nodeAffinity == nil || len(nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution) == 0 {
+		return nil, nil
+	}
+
+	expressions := make([]api.NodeSelectorRequirement, 0, len(nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution))
+	for _, match := range nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		keyValue := strings.SplitN(match, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid node affinity match expression %q: expected \"key=value\"", match)
+		}
+
+		expressions = append(expressions, api.NodeSelectorRequirement{
+			Key:      keyValue[0],
+			Operator: api.NodeSelectorOpIn,
+			Values:   []string{keyValue[1]},
+		})
+	}
+
+	return &api.Affinity{
+		NodeAffinity: &api.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &api.NodeSelector{
+				NodeSelectorTerms: []api.NodeSelectorTerm{
+					{MatchExpressions: expressions},
+				},
+			},
+		},
+	}, nil
+}
+
+// resourceEphemeralStorage names the ephemeral-storage resource. This api
+// package predates upstream Kubernetes adding api.ResourceEphemeralStorage
+// as a named constant, so it's spelled out as a literal api.ResourceName
+// instead of relying on a symbol this vendored revision doesn't have.
+const resourceEphemeralStorage api.ResourceName = "ephemeral-storage"
+
+// resources takes the user-supplied quantity strings for CPU, memory and
+// ephemeral storage requests/limits (e.g. "500m" for CPU, "50Mi" for memory)
+// plus a map of arbitrary extended resources (e.g. "nvidia.com/gpu": "1"),
+// and builds the api.ResourceRequirements for a build container. Unlike the
+// old limits helper, a parse failure is returned to the caller instead of
+// silently producing an empty ResourceList, and a request that exceeds its
+// matching limit is rejected so a misconfigured runner fails fast instead of
+// at pod scheduling time.
+func resources(requestsCPU, requestsMemory, limitsCPU, limitsMemory, ephemeralStorageRequest, ephemeralStorageLimit string, extended map[string]string) (api.ResourceRequirements, error) {
+	requests := make(api.ResourceList)
+	limits := make(api.ResourceList)
+
+	for _, q := range []struct {
+		list  api.ResourceList
+		name  api.ResourceName
+		value string
+	}{
+		{requests, api.ResourceCPU, requestsCPU},
+		{limits, api.ResourceCPU, limitsCPU},
+		{requests, api.ResourceMemory, requestsMemory},
+		{limits, api.ResourceMemory, limitsMemory},
+		{requests, resourceEphemeralStorage, ephemeralStorageRequest},
+		{limits, resourceEphemeralStorage, ephemeralStorageLimit},
+	} {
+		if err := setQuantity(q.list, q.name, q.value); err != nil {
+			return api.ResourceRequirements{}, err
+		}
+	}
+
+	for name, value := range extended {
+		if err := setQuantity(requests, api.ResourceName(name), value); err != nil {
+			return api.ResourceRequirements{}, err
+		}
+		if err := setQuantity(limits, api.ResourceName(name), value); err != nil {
+			return api.ResourceRequirements{}, err
+		}
+	}
+
+	if err := validateRequestsWithinLimits(requests, limits); err != nil {
+		return api.ResourceRequirements{}, err
+	}
+
+	return api.ResourceRequirements{Requests: requests, Limits: limits}, nil
+}
+
+func setQuantity(list api.ResourceList, name api.ResourceName, value string) error {
+	if len(value) == 0 {
+		return nil
+	}
+
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return fmt.Errorf("error parsing %s quantity %q: %s", name, value, err.Error())
+	}
+
+	list[name] = q
+	return nil
+}
+
+// validateRequestsWithinLimits fails fast if any resource's request exceeds
+// its limit, rather than letting the scheduler reject the pod later.
+func validateRequestsWithinLimits(requests, limits api.ResourceList) error {
+	for name, request := range requests {
+		limit, ok := limits[name]
+		if !ok {
+			continue
+		}
+		if request.Cmp(limit) > 0 {
+			return fmt.Errorf("%s request (%s) exceeds limit (%s)", name, request.String(), limit.String())
 		}
 	}
-	return e
+	return nil
 }
@@ -0,0 +1,106 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+func TestNextBackoff(t *testing.T) {
+	tests := []struct {
+		cur, want time.Duration
+	}{
+		{watchMinBackoff, watchMinBackoff * 2},
+		{watchMaxBackoff, watchMaxBackoff},
+		{watchMaxBackoff / 2, watchMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := nextBackoff(tt.cur); got != tt.want {
+			t.Errorf("nextBackoff(%s) = %s, want %s", tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestDrainPodWatchForwardsAddedAndModified(t *testing.T) {
+	w := watch.NewFake()
+	events := make(chan *api.Pod, 2)
+	ctx := context.Background()
+
+	go func() {
+		w.Add(&api.Pod{ObjectMeta: api.ObjectMeta{ResourceVersion: "1"}})
+		w.Modify(&api.Pod{ObjectMeta: api.ObjectMeta{ResourceVersion: "2"}})
+		w.Stop()
+	}()
+
+	nextResourceVersion, reconnect := drainPodWatch(ctx, w, events, "0")
+
+	if !reconnect {
+		t.Fatal("expected reconnect=true when the watch channel closes normally")
+	}
+	if nextResourceVersion != "2" {
+		t.Fatalf("nextResourceVersion = %q, want %q", nextResourceVersion, "2")
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+}
+
+func TestDrainPodWatchDeletedStopsReconnecting(t *testing.T) {
+	w := watch.NewFake()
+	events := make(chan *api.Pod, 1)
+	ctx := context.Background()
+
+	go w.Delete(&api.Pod{ObjectMeta: api.ObjectMeta{ResourceVersion: "1"}})
+
+	_, reconnect := drainPodWatch(ctx, w, events, "0")
+	if reconnect {
+		t.Fatal("expected reconnect=false after a Deleted event")
+	}
+
+	p := <-events
+	if p.Status.Phase != api.PodFailed {
+		t.Fatalf("phase = %s, want %s", p.Status.Phase, api.PodFailed)
+	}
+}
+
+func TestDrainPodWatchErrorResetsResourceVersion(t *testing.T) {
+	w := watch.NewFake()
+	events := make(chan *api.Pod)
+	ctx := context.Background()
+
+	go w.Error(&api.Status{Message: "too old resource version"})
+
+	nextResourceVersion, reconnect := drainPodWatch(ctx, w, events, "123")
+	if !reconnect {
+		t.Fatal("expected reconnect=true after a watch.Error event")
+	}
+	if nextResourceVersion != "" {
+		t.Fatalf("nextResourceVersion = %q, want empty string", nextResourceVersion)
+	}
+}
+
+func TestDrainPodWatchDoesNotBlockForeverWhenCtxDone(t *testing.T) {
+	w := watch.NewFake()
+	events := make(chan *api.Pod) // unbuffered and never drained
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		drainPodWatch(ctx, w, events, "0")
+		close(done)
+	}()
+
+	w.Add(&api.Pod{ObjectMeta: api.ObjectMeta{ResourceVersion: "1"}})
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drainPodWatch blocked forever on an unguarded events send")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+	"golang.org/x/net/http2"
 	"io"
 	"io/ioutil"
 	"net"
@@ -27,35 +28,84 @@ var dialer = net.Dialer{
 	KeepAlive: 30 * time.Second,
 }
 
+// tlsProfile is a named TLS minimum-version/cipher-suite policy selectable
+// via RunnerCredentials.TLSProfile. cipherSuites left nil lets crypto/tls
+// pick its own secure default list (only meaningful for TLS 1.2 and below;
+// TLS 1.3 suites aren't configurable).
+type tlsProfile struct {
+	name         string
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+var tlsProfiles = map[string]tlsProfile{
+	common.TLSProfileSecure: {
+		name:       common.TLSProfileSecure,
+		minVersion: tls.VersionTLS13,
+	},
+	common.TLSProfileDefault: {
+		name:       common.TLSProfileDefault,
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	},
+	common.TLSProfileLegacy: {
+		name:       common.TLSProfileLegacy,
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		},
+	},
+}
+
+// resolveTLSProfile looks up name in tlsProfiles, falling back to the
+// "default" profile for an empty or unrecognised name so a typo in runner
+// config degrades to a sane policy rather than silently using TLS 1.0.
+func resolveTLSProfile(name string) tlsProfile {
+	if profile, ok := tlsProfiles[name]; ok {
+		return profile
+	}
+	return tlsProfiles[common.TLSProfileDefault]
+}
+
 type client struct {
 	http.Client
 	url        *url.URL
 	caFile     string
-	caData     []byte
 	skipVerify bool
-	updateTime time.Time
+	tlsProfile string
+	transport  *lockedTransport
 }
 
-func (n *client) ensureTLSConfig() {
-	// certificate got modified
-	if stat, err := os.Stat(n.caFile); err == nil && n.updateTime.Before(stat.ModTime()) {
-		n.Transport = nil
-	}
+// buildTransport constructs the *http.Transport for n's current caFile and
+// tlsProfile, along with the raw CA bytes it loaded (if any). It has no
+// side effects on n; the caller is responsible for publishing the result
+// via n.transport.set.
+func (n *client) buildTransport() (*http.Transport, []byte) {
+	profile := resolveTLSProfile(n.tlsProfile)
 
-	// create or update transport
-	if n.Transport == nil {
-		n.updateTime = time.Now()
-		n.createTransport()
-	}
-}
-
-func (n *client) createTransport() {
 	// create reference TLS config
 	tlsConfig := tls.Config{
-		MinVersion:         tls.VersionTLS10,
+		MinVersion:         profile.minVersion,
+		CipherSuites:       profile.cipherSuites,
 		InsecureSkipVerify: n.skipVerify,
 	}
 
+	var caData []byte
+
 	// load TLS certificate
 	if file := n.caFile; file != "" && !n.skipVerify {
 		logrus.Debugln("Trying to load", file, "...")
@@ -65,7 +115,7 @@ func (n *client) createTransport() {
 			pool := x509.NewCertPool()
 			if pool.AppendCertsFromPEM(data) {
 				tlsConfig.RootCAs = pool
-				n.caData = data
+				caData = data
 			} else {
 				logrus.Errorln("Failed to parse PEM in", n.caFile)
 			}
@@ -74,10 +124,14 @@ func (n *client) createTransport() {
 				logrus.Errorln("Failed to load", n.caFile, err)
 			}
 		}
+	} else if !n.skipVerify {
+		// fall back to the system trust store (plus SSL_CERT_FILE, if set)
+		// when the runner hasn't pinned a specific CA
+		tlsConfig.RootCAs = systemCertPool()
 	}
 
 	// create transport
-	n.Transport = &http.Transport{
+	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		Dial: func(network, addr string) (net.Conn, error) {
 			logrus.Debugln("Dialing:", network, addr, "...")
@@ -86,11 +140,45 @@ func (n *client) createTransport() {
 		TLSHandshakeTimeout: 10 * time.Second,
 		TLSClientConfig:     &tlsConfig,
 	}
+
+	if err := http2.ConfigureTransport(transport); err != nil {
+		logrus.Warnln("Failed to enable HTTP/2, falling back to HTTP/1.1:", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"host":    n.url.Host,
+		"profile": profile.name,
+	}).Infoln("Negotiated TLS profile")
+
+	return transport, caData
+}
+
+// systemCertPool returns the host's trusted root CAs, extended with
+// SSL_CERT_FILE if set, so operators can add a CA without touching
+// TLSCAFile. A fresh, possibly-empty pool is returned if the system pool
+// can't be loaded (e.g. unsupported platform) rather than failing the
+// request outright.
+func systemCertPool() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			logrus.Errorln("Failed to load SSL_CERT_FILE", file, err)
+		} else if !pool.AppendCertsFromPEM(data) {
+			logrus.Errorln("Failed to parse PEM in SSL_CERT_FILE", file)
+		}
+	}
+
+	return pool
 }
 
 func (n *client) getCAChain(tls *tls.ConnectionState) string {
-	if len(n.caData) != 0 {
-		return string(n.caData)
+	if caData := n.transport.getCAData(); len(caData) != 0 {
+		return string(caData)
 	}
 
 	if tls == nil {
@@ -144,8 +232,6 @@ func (n *client) do(uri, method string, request io.Reader, requestType string, h
 		req.Header.Set("User-Agent", common.AppVersion.UserAgent())
 	}
 
-	n.ensureTLSConfig()
-
 	res, err = n.Do(req)
 	if err != nil {
 		err = fmt.Errorf("couldn't execute %v against %s: %v", req.Method, req.URL, err)
@@ -214,9 +300,10 @@ func newClient(config common.RunnerCredentials) (c *client, err error) {
 	}
 
 	c = &client{
-		url:    url,
-		caFile: config.TLSCAFile,
-		skipVerify: true,
+		url:        url,
+		caFile:     config.TLSCAFile,
+		tlsProfile: config.TLSProfile,
+		skipVerify: false,
 	}
 
 	if CertificateDirectory != "" && c.caFile == "" {
@@ -224,5 +311,12 @@ func newClient(config common.RunnerCredentials) (c *client, err error) {
 		c.caFile = filepath.Join(CertificateDirectory, hostAndPort[0]+".crt")
 	}
 
+	c.transport = &lockedTransport{}
+	transport, caData := c.buildTransport()
+	c.transport.set(transport, caData)
+	c.Client.Transport = c.transport
+
+	go c.watchCAFile()
+
 	return
 }
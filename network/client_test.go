@@ -0,0 +1,70 @@
+package network
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-ci-multi-runner/common"
+)
+
+func TestResolveTLSProfile(t *testing.T) {
+	tests := []struct {
+		name           string
+		profile        string
+		wantName       string
+		wantMinVersion uint16
+		wantCiphers    bool
+	}{
+		{
+			name:           "secure profile is TLS 1.3 only with no cipher list",
+			profile:        common.TLSProfileSecure,
+			wantName:       common.TLSProfileSecure,
+			wantMinVersion: tls.VersionTLS13,
+			wantCiphers:    false,
+		},
+		{
+			name:           "default profile is TLS 1.2+ with a curated cipher list",
+			profile:        common.TLSProfileDefault,
+			wantName:       common.TLSProfileDefault,
+			wantMinVersion: tls.VersionTLS12,
+			wantCiphers:    true,
+		},
+		{
+			name:           "legacy profile is TLS 1.2+ with a broader cipher list",
+			profile:        common.TLSProfileLegacy,
+			wantName:       common.TLSProfileLegacy,
+			wantMinVersion: tls.VersionTLS12,
+			wantCiphers:    true,
+		},
+		{
+			name:           "empty profile falls back to default",
+			profile:        "",
+			wantName:       common.TLSProfileDefault,
+			wantMinVersion: tls.VersionTLS12,
+			wantCiphers:    true,
+		},
+		{
+			name:           "unrecognised profile falls back to default",
+			profile:        "not-a-real-profile",
+			wantName:       common.TLSProfileDefault,
+			wantMinVersion: tls.VersionTLS12,
+			wantCiphers:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveTLSProfile(tt.profile)
+
+			if got.name != tt.wantName {
+				t.Errorf("name = %q, want %q", got.name, tt.wantName)
+			}
+			if got.minVersion != tt.wantMinVersion {
+				t.Errorf("minVersion = %#x, want %#x", got.minVersion, tt.wantMinVersion)
+			}
+			if (len(got.cipherSuites) > 0) != tt.wantCiphers {
+				t.Errorf("len(cipherSuites) > 0 = %v, want %v", len(got.cipherSuites) > 0, tt.wantCiphers)
+			}
+		})
+	}
+}
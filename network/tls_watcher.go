@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// caWatchFallbackPoll bounds how stale the transport can get when fsnotify
+// can't be used (or silently misses an event, which atomic rename-based
+// rotations are known to do on some filesystems): the watcher re-reads
+// caFile at least this often regardless of what inotify reports.
+const caWatchFallbackPoll = 30 * time.Second
+
+// lockedTransport lets watchCAFile swap the *http.Transport a client uses
+// while requests are in flight. RoundTrip only ever takes a read lock, so
+// the request path pays no extra cost beyond that; watchCAFile takes the
+// write lock to publish a rebuilt transport after a CA rotation.
+type lockedTransport struct {
+	mu        sync.RWMutex
+	transport *http.Transport
+	caData    []byte
+}
+
+func (t *lockedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	transport := t.transport
+	t.mu.RUnlock()
+	return transport.RoundTrip(req)
+}
+
+func (t *lockedTransport) set(transport *http.Transport, caData []byte) {
+	t.mu.Lock()
+	t.transport = transport
+	t.caData = caData
+	t.mu.Unlock()
+}
+
+func (t *lockedTransport) getCAData() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.caData
+}
+
+// watchCAFile rebuilds n's transport whenever n.caFile's contents change.
+// It watches the file's containing directory with fsnotify, since
+// cert-manager and similar tools rotate certificates with an atomic
+// rename/symlink-swap that a plain stat on the file itself can miss between
+// checks, and runs a slower periodic poll alongside it as a fallback for
+// filesystems where inotify isn't available. It returns at once when caFile
+// is empty; otherwise it never returns.
+func (n *client) watchCAFile() {
+	if n.caFile == "" {
+		return
+	}
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Warnln("Failed to start CA file watcher, falling back to polling only:", err)
+	} else {
+		defer watcher.Close()
+
+		if err := watcher.Add(filepath.Dir(n.caFile)); err != nil {
+			logrus.Warnln("Failed to watch", filepath.Dir(n.caFile), "for CA rotation, falling back to polling only:", err)
+		} else {
+			events = watcher.Events
+			errs = watcher.Errors
+		}
+	}
+
+	ticker := time.NewTicker(caWatchFallbackPoll)
+	defer ticker.Stop()
+
+	lastData := n.transport.getCAData()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(n.caFile) {
+				continue
+			}
+			lastData = n.reloadCAIfChanged(lastData)
+
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			logrus.Warnln("CA file watcher error:", err)
+
+		case <-ticker.C:
+			lastData = n.reloadCAIfChanged(lastData)
+		}
+	}
+}
+
+// reloadCAIfChanged rebuilds and publishes n's transport if caFile's
+// contents differ from lastData, returning whichever data is now current.
+func (n *client) reloadCAIfChanged(lastData []byte) []byte {
+	data, err := ioutil.ReadFile(n.caFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorln("Failed to read CA file", n.caFile, "during rotation check:", err)
+		}
+		return lastData
+	}
+
+	if bytes.Equal(data, lastData) {
+		return lastData
+	}
+
+	logrus.Infoln("Detected CA file rotation for", n.caFile, "- rebuilding TLS transport")
+	transport, caData := n.buildTransport()
+	n.transport.set(transport, caData)
+	return caData
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCAPEM returns a freshly generated self-signed CA certificate, PEM
+// encoded; buildTransport only publishes CA data that parses as PEM
+// certificates. Every call returns different bytes.
+func testCAPEM(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func newTestClient(t *testing.T, caFile string) *client {
+	u, err := url.Parse("https://example.com/ci/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := &client{url: u, caFile: caFile}
+	c.transport = &lockedTransport{}
+	transport, caData := c.buildTransport()
+	c.transport.set(transport, caData)
+
+	return c
+}
+
+func TestReloadCAIfChangedRebuildsOnContentChange(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	original := testCAPEM(t)
+	if err := ioutil.WriteFile(caFile, original, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := newTestClient(t, caFile)
+	lastData := c.transport.getCAData()
+	if string(lastData) != string(original) {
+		t.Fatalf("initial CA data = %q, want %q", lastData, original)
+	}
+
+	rotated := testCAPEM(t)
+	if err := ioutil.WriteFile(caFile, rotated, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := c.reloadCAIfChanged(lastData)
+	if string(got) != string(rotated) {
+		t.Errorf("reloadCAIfChanged returned %q, want %q", got, rotated)
+	}
+	if string(c.transport.getCAData()) != string(rotated) {
+		t.Errorf("published CA data = %q, want %q", c.transport.getCAData(), rotated)
+	}
+}
+
+func TestReloadCAIfChangedNoopWhenUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	original := testCAPEM(t)
+	if err := ioutil.WriteFile(caFile, original, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := newTestClient(t, caFile)
+	lastData := c.transport.getCAData()
+
+	got := c.reloadCAIfChanged(lastData)
+	if string(got) != string(original) {
+		t.Errorf("reloadCAIfChanged returned %q, want %q", got, original)
+	}
+}
+
+func TestReloadCAIfChangedKeepsLastDataOnReadError(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+
+	original := testCAPEM(t)
+	if err := ioutil.WriteFile(caFile, original, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := newTestClient(t, caFile)
+	lastData := c.transport.getCAData()
+
+	if err := os.Remove(caFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := c.reloadCAIfChanged(lastData)
+	if string(got) != string(original) {
+		t.Errorf("reloadCAIfChanged returned %q, want %q (unchanged on read error)", got, original)
+	}
+}